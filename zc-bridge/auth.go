@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	rpcRateBurst  = 20 // requests
+	rpcRatePerSec = 10 // requests/sec sustained
+)
+
+var allowedOrigins = parseOrigins(getenv("ZC_BRIDGE_ALLOWED_ORIGINS", ""))
+
+// parseOrigins splits a comma-separated ZC_BRIDGE_ALLOWED_ORIGINS value.
+// An empty list means "allow any origin" (the pre-auth default).
+func parseOrigins(v string) []string {
+	if v == "" {
+		return nil
+	}
+	var out []string
+	for _, o := range strings.Split(v, ",") {
+		o = strings.TrimSpace(o)
+		if o != "" {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// checkOrigin is the upgrader.CheckOrigin callback: it allows requests with
+// no Origin header (non-browser clients) and enforces the allow-list when
+// ZC_BRIDGE_ALLOWED_ORIGINS is configured.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(allowedOrigins) == 0 {
+		return true
+	}
+	for _, o := range allowedOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBearerToken enforces an optional bearer token on the HTTP upgrade
+// request. When ZC_BRIDGE_BEARER_TOKEN is unset, all requests pass.
+func checkBearerToken(r *http.Request) bool {
+	required := getenv("ZC_BRIDGE_BEARER_TOKEN", "")
+	if required == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(required)) == 1
+}
+
+// verifyConnect checks the HMAC-SHA256 of nonce against ZC_BRIDGE_SECRET, as
+// supplied by the client's "connect" request params. When ZC_BRIDGE_SECRET
+// is unset, the check is skipped (matches the pre-auth, secretless setup).
+func verifyConnect(nonce string, params json.RawMessage) error {
+	secret := getenv("ZC_BRIDGE_SECRET", "")
+	if secret == "" {
+		return nil
+	}
+
+	var p struct {
+		Signature string `json:"signature"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return fmt.Errorf("auth_required: invalid connect params")
+		}
+	}
+	if p.Signature == "" {
+		return fmt.Errorf("auth_required: missing signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if subtle.ConstantTimeCompare([]byte(p.Signature), []byte(want)) != 1 {
+		return fmt.Errorf("auth_failed: signature mismatch")
+	}
+	return nil
+}
+
+// closeConn sends a proper WebSocket close frame before the caller tears
+// down the connection.
+func closeConn(ws *websocket.Conn, writeMu *sync.Mutex, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	safeWriteControl(ws, writeMu, websocket.CloseMessage, msg, time.Now().Add(2*time.Second))
+}
+
+// tokenBucket is a simple per-connection rate limiter for RPC calls.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64 // tokens refilled per second
+	last     time.Time
+}
+
+func newTokenBucket(capacity, ratePerSec float64) *tokenBucket {
+	return &tokenBucket{
+		tokens:   capacity,
+		capacity: capacity,
+		rate:     ratePerSec,
+		last:     time.Now(),
+	}
+}
+
+// Allow consumes one token if available, refilling based on elapsed time.
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func signNonce(t *testing.T, secret, nonce string) string {
+	t.Helper()
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyConnectNoSecretConfigured(t *testing.T) {
+	t.Setenv("ZC_BRIDGE_SECRET", "")
+	if err := verifyConnect("any-nonce", nil); err != nil {
+		t.Fatalf("expected no error when ZC_BRIDGE_SECRET is unset, got %v", err)
+	}
+}
+
+func TestVerifyConnectValidSignature(t *testing.T) {
+	t.Setenv("ZC_BRIDGE_SECRET", "s3cret")
+	nonce := "nonce-123"
+	params, _ := json.Marshal(map[string]string{"signature": signNonce(t, "s3cret", nonce)})
+	if err := verifyConnect(nonce, params); err != nil {
+		t.Fatalf("expected valid signature to verify, got %v", err)
+	}
+}
+
+func TestVerifyConnectMissingSignature(t *testing.T) {
+	t.Setenv("ZC_BRIDGE_SECRET", "s3cret")
+	if err := verifyConnect("nonce-123", nil); err == nil {
+		t.Fatal("expected error for missing signature")
+	}
+}
+
+func TestVerifyConnectMismatchedSignature(t *testing.T) {
+	t.Setenv("ZC_BRIDGE_SECRET", "s3cret")
+	nonce := "nonce-123"
+	params, _ := json.Marshal(map[string]string{"signature": signNonce(t, "wrong-secret", nonce)})
+	if err := verifyConnect(nonce, params); err == nil {
+		t.Fatal("expected error for mismatched signature")
+	}
+}
+
+func TestTokenBucketAllowsUpToBurstThenBlocks(t *testing.T) {
+	b := newTokenBucket(3, 0)
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("expected request %d within burst to be allowed", i)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("expected request beyond burst capacity to be denied")
+	}
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	b := newTokenBucket(1, 1000) // 1000 tokens/sec refill, trivially fast for a test
+	if !b.Allow() {
+		t.Fatal("expected first request to be allowed")
+	}
+	if b.Allow() {
+		t.Fatal("expected bucket to be empty immediately after spending its only token")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("expected bucket to have refilled after waiting")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pongWait is how long a connection may go without a client pong (or any
+// other inbound frame) before it is considered idle and torn down. It is
+// kept comfortably above the heartbeat interval used by heartbeat() so a
+// single missed ping doesn't trip it.
+const pongWait = 60 * time.Second
+
+const defaultUpstreamTimeout = 30 * time.Second
+
+// upstreamTimeout is the deadline applied to outbound provider calls, via
+// ZC_BRIDGE_UPSTREAM_TIMEOUT. An unset or invalid value falls back to
+// defaultUpstreamTimeout.
+func upstreamTimeout() time.Duration {
+	v := getenv("ZC_BRIDGE_UPSTREAM_TIMEOUT", "")
+	if v == "" {
+		return defaultUpstreamTimeout
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return defaultUpstreamTimeout
+	}
+	return d
+}
+
+// abortState maps a run's context error to the agent-event state that
+// should be emitted to the client, distinguishing an explicit chat.cancel
+// from an upstream timeout so the UI can render them differently. Returns
+// "" when the context was not aborted.
+func abortState(ctx context.Context) string {
+	switch ctx.Err() {
+	case context.Canceled:
+		return "aborted"
+	case context.DeadlineExceeded:
+		return "timeout"
+	default:
+		return ""
+	}
+}
+
+// deadlineTimer is a resettable idle-timeout watchdog modeled on the
+// shared-deadline-timer pattern from netstack's gonet adapter: a single
+// "done" channel closed by a time.AfterFunc, reset on each I/O boundary
+// instead of allocating a fresh timer per read.
+type deadlineTimer struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	done  chan struct{}
+}
+
+// newDeadlineTimer starts a deadlineTimer that fires after d unless reset.
+func newDeadlineTimer(d time.Duration) *deadlineTimer {
+	dt := &deadlineTimer{done: make(chan struct{})}
+	done := dt.done
+	dt.timer = time.AfterFunc(d, func() { close(done) })
+	return dt
+}
+
+// C returns the channel that is closed when the timer fires. A watcher
+// that blocks on a stale C() forever after a Reset is a bug: Reset closes
+// the previous generation's channel too, so a blocked watcher always wakes
+// up and must check IsCurrent before treating that as a real expiry.
+func (dt *deadlineTimer) C() <-chan struct{} {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.done
+}
+
+// IsCurrent reports whether c is still the channel for the timer's current
+// generation. A watcher calls this after c fires to tell a genuine expiry
+// apart from a Reset that raced in and superseded the generation it was
+// watching.
+func (dt *deadlineTimer) IsCurrent(c <-chan struct{}) bool {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return c == dt.done
+}
+
+// Reset pushes the deadline out by d, as if the timer had just been
+// created. If a watcher is currently parked on a prior generation's C(),
+// that channel is closed immediately so the watcher wakes up and re-fetches
+// C() instead of blocking on one that would otherwise never fire again.
+func (dt *deadlineTimer) Reset(d time.Duration) {
+	dt.mu.Lock()
+	old := dt.done
+	stopped := dt.timer.Stop()
+	done := make(chan struct{})
+	dt.done = done
+	dt.timer = time.AfterFunc(d, func() { close(done) })
+	dt.mu.Unlock()
+
+	// Only close old if we actually stopped it before it fired - if Stop
+	// returned false, its own AfterFunc already closed it, and closing an
+	// already-closed channel panics.
+	if stopped {
+		close(old)
+	}
+}
+
+// Stop releases the underlying timer without firing.
+func (dt *deadlineTimer) Stop() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.timer.Stop()
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// HistoryStore persists chat messages per session across process restarts.
+// Append/List/Delete/Search must be safe for concurrent use.
+type HistoryStore interface {
+	Append(sessionKey string, msg ChatMessage) error
+	List(sessionKey string, limit int, before, after time.Time) ([]ChatMessage, error)
+	Delete(sessionKey string) error
+	Search(sessionKey, query string) ([]ChatMessage, error)
+
+	// RecordUsage adds one usage increment for sessionKey/model.
+	RecordUsage(sessionKey, model string, inputTokens, outputTokens int64, costUsd float64) error
+	// UsageBySession returns the running totals for one session.
+	UsageBySession(sessionKey string) (UsageTotals, error)
+	// UsageByModel returns running totals grouped by model.
+	UsageByModel() (map[string]UsageTotals, error)
+	// UsageTotal returns the running totals across every session.
+	UsageTotal() (UsageTotals, error)
+	// ResetUsage clears every recorded usage increment.
+	ResetUsage() error
+}
+
+// UsageTotals aggregates token counts and cost for a session or model.
+type UsageTotals struct {
+	InputTokens  int64   `json:"inputTokens"`
+	OutputTokens int64   `json:"outputTokens"`
+	CostUsd      float64 `json:"costUsd"`
+}
+
+func (t *UsageTotals) add(inputTokens, outputTokens int64, costUsd float64) {
+	t.InputTokens += inputTokens
+	t.OutputTokens += outputTokens
+	t.CostUsd += costUsd
+}
+
+// newHistoryStore builds the backend selected by ZC_BRIDGE_STORE
+// ("memory", "sqlite", or "jsonl"). Defaults to in-memory.
+func newHistoryStore(kind string) (HistoryStore, error) {
+	switch kind {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		path := getenv("ZC_BRIDGE_SQLITE_PATH", "zc-bridge.db")
+		return newSQLiteStore(path)
+	case "jsonl":
+		path := getenv("ZC_BRIDGE_JSONL_PATH", "zc-bridge-history.jsonl")
+		return newJSONLStore(path)
+	default:
+		return nil, fmt.Errorf("unknown ZC_BRIDGE_STORE backend: %q", kind)
+	}
+}
+
+// filterAndLimit applies the before/after cursors and limit shared by all
+// backends once they've loaded a session's full message slice (oldest
+// first). With a before cursor (or no cursor), limit keeps the newest N
+// matches, for backward pagination from the end of history. With an after
+// cursor, limit instead keeps the oldest N matches - the N messages
+// immediately following the cursor - so repeated calls with an advancing
+// after walk forward through history instead of re-returning the same tail.
+func filterAndLimit(msgs []ChatMessage, limit int, before, after time.Time) []ChatMessage {
+	out := msgs[:0:0]
+	for _, m := range msgs {
+		if !before.IsZero() && !m.Timestamp.Before(before) {
+			continue
+		}
+		if !after.IsZero() && !m.Timestamp.After(after) {
+			continue
+		}
+		out = append(out, m)
+	}
+	if limit > 0 && len(out) > limit {
+		if !after.IsZero() {
+			out = out[:limit]
+		} else {
+			out = out[len(out)-limit:]
+		}
+	}
+	return out
+}
+
+// --- in-memory backend (original behavior) ---
+
+type memoryStore struct {
+	mu             sync.Mutex
+	data           map[string][]ChatMessage
+	usageBySession map[string]*UsageTotals
+	usageByModel   map[string]*UsageTotals
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		data:           map[string][]ChatMessage{},
+		usageBySession: map[string]*UsageTotals{},
+		usageByModel:   map[string]*UsageTotals{},
+	}
+}
+
+func (s *memoryStore) Append(sessionKey string, msg ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[sessionKey] = append(s.data[sessionKey], msg)
+	return nil
+}
+
+func (s *memoryStore) List(sessionKey string, limit int, before, after time.Time) ([]ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return filterAndLimit(s.data[sessionKey], limit, before, after), nil
+}
+
+func (s *memoryStore) Delete(sessionKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, sessionKey)
+	return nil
+}
+
+func (s *memoryStore) Search(sessionKey, query string) ([]ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []ChatMessage
+	for _, m := range s.data[sessionKey] {
+		if messageContains(m, query) {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) RecordUsage(sessionKey, model string, inputTokens, outputTokens int64, costUsd float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bySession, ok := s.usageBySession[sessionKey]
+	if !ok {
+		bySession = &UsageTotals{}
+		s.usageBySession[sessionKey] = bySession
+	}
+	bySession.add(inputTokens, outputTokens, costUsd)
+
+	byModel, ok := s.usageByModel[model]
+	if !ok {
+		byModel = &UsageTotals{}
+		s.usageByModel[model] = byModel
+	}
+	byModel.add(inputTokens, outputTokens, costUsd)
+
+	return nil
+}
+
+func (s *memoryStore) UsageBySession(sessionKey string) (UsageTotals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.usageBySession[sessionKey]; ok {
+		return *t, nil
+	}
+	return UsageTotals{}, nil
+}
+
+func (s *memoryStore) UsageByModel() (map[string]UsageTotals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]UsageTotals, len(s.usageByModel))
+	for model, t := range s.usageByModel {
+		out[model] = *t
+	}
+	return out, nil
+}
+
+func (s *memoryStore) UsageTotal() (UsageTotals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total UsageTotals
+	for _, t := range s.usageBySession {
+		total.add(t.InputTokens, t.OutputTokens, t.CostUsd)
+	}
+	return total, nil
+}
+
+func (s *memoryStore) ResetUsage() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usageBySession = map[string]*UsageTotals{}
+	s.usageByModel = map[string]*UsageTotals{}
+	return nil
+}
+
+// --- SQLite backend ---
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite store: %w", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (
+        session_key TEXT NOT NULL,
+        role        TEXT NOT NULL,
+        text        TEXT NOT NULL,
+        ts          INTEGER NOT NULL
+    )`)
+	if err != nil {
+		return nil, fmt.Errorf("migrate sqlite store: %w", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS usage (
+        session_key    TEXT NOT NULL,
+        model          TEXT NOT NULL,
+        input_tokens   INTEGER NOT NULL,
+        output_tokens  INTEGER NOT NULL,
+        cost_usd       REAL NOT NULL,
+        ts             INTEGER NOT NULL
+    )`)
+	if err != nil {
+		return nil, fmt.Errorf("migrate sqlite store: %w", err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Append(sessionKey string, msg ChatMessage) error {
+	text := ""
+	if len(msg.Content) > 0 {
+		text = msg.Content[0].Text
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO messages (session_key, role, text, ts) VALUES (?, ?, ?, ?)`,
+		sessionKey, msg.Role, text, msg.Timestamp.UnixNano(),
+	)
+	return err
+}
+
+func (s *sqliteStore) List(sessionKey string, limit int, before, after time.Time) ([]ChatMessage, error) {
+	rows, err := s.db.Query(
+		`SELECT role, text, ts FROM messages WHERE session_key = ? ORDER BY ts ASC`,
+		sessionKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []ChatMessage
+	for rows.Next() {
+		var role, text string
+		var ts int64
+		if err := rows.Scan(&role, &text, &ts); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, ChatMessage{
+			Role:      role,
+			Content:   []ContentBlock{{Type: "text", Text: text}},
+			Timestamp: time.Unix(0, ts),
+		})
+	}
+	return filterAndLimit(msgs, limit, before, after), rows.Err()
+}
+
+func (s *sqliteStore) Delete(sessionKey string) error {
+	_, err := s.db.Exec(`DELETE FROM messages WHERE session_key = ?`, sessionKey)
+	return err
+}
+
+func (s *sqliteStore) Search(sessionKey, query string) ([]ChatMessage, error) {
+	// Case-insensitive, matching the memory/jsonl backends' messageContains
+	// so chat.history.search returns identical results across backends.
+	rows, err := s.db.Query(
+		`SELECT role, text, ts FROM messages WHERE session_key = ? AND LOWER(text) LIKE LOWER(?) ORDER BY ts ASC`,
+		sessionKey, "%"+query+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []ChatMessage
+	for rows.Next() {
+		var role, text string
+		var ts int64
+		if err := rows.Scan(&role, &text, &ts); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, ChatMessage{
+			Role:      role,
+			Content:   []ContentBlock{{Type: "text", Text: text}},
+			Timestamp: time.Unix(0, ts),
+		})
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqliteStore) RecordUsage(sessionKey, model string, inputTokens, outputTokens int64, costUsd float64) error {
+	_, err := s.db.Exec(
+		`INSERT INTO usage (session_key, model, input_tokens, output_tokens, cost_usd, ts) VALUES (?, ?, ?, ?, ?, ?)`,
+		sessionKey, model, inputTokens, outputTokens, costUsd, time.Now().UnixNano(),
+	)
+	return err
+}
+
+func (s *sqliteStore) UsageBySession(sessionKey string) (UsageTotals, error) {
+	var t UsageTotals
+	row := s.db.QueryRow(
+		`SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0), COALESCE(SUM(cost_usd), 0)
+         FROM usage WHERE session_key = ?`,
+		sessionKey,
+	)
+	err := row.Scan(&t.InputTokens, &t.OutputTokens, &t.CostUsd)
+	return t, err
+}
+
+func (s *sqliteStore) UsageByModel() (map[string]UsageTotals, error) {
+	rows, err := s.db.Query(
+		`SELECT model, SUM(input_tokens), SUM(output_tokens), SUM(cost_usd) FROM usage GROUP BY model`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]UsageTotals{}
+	for rows.Next() {
+		var model string
+		var t UsageTotals
+		if err := rows.Scan(&model, &t.InputTokens, &t.OutputTokens, &t.CostUsd); err != nil {
+			return nil, err
+		}
+		out[model] = t
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) UsageTotal() (UsageTotals, error) {
+	var t UsageTotals
+	row := s.db.QueryRow(
+		`SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0), COALESCE(SUM(cost_usd), 0) FROM usage`,
+	)
+	err := row.Scan(&t.InputTokens, &t.OutputTokens, &t.CostUsd)
+	return t, err
+}
+
+func (s *sqliteStore) ResetUsage() error {
+	_, err := s.db.Exec(`DELETE FROM usage`)
+	return err
+}
+
+// --- JSONL append-only file backend ---
+
+type jsonlRecord struct {
+	SessionKey string      `json:"sessionKey"`
+	Message    ChatMessage `json:"message"`
+}
+
+type jsonlStore struct {
+	mu        sync.Mutex
+	path      string
+	usagePath string
+}
+
+func newJSONLStore(path string) (*jsonlStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open jsonl store: %w", err)
+	}
+	f.Close()
+	return &jsonlStore{path: path, usagePath: path + ".usage"}, nil
+}
+
+// jsonlUsageRecord is one append-only usage increment.
+type jsonlUsageRecord struct {
+	SessionKey   string  `json:"sessionKey"`
+	Model        string  `json:"model"`
+	InputTokens  int64   `json:"inputTokens"`
+	OutputTokens int64   `json:"outputTokens"`
+	CostUsd      float64 `json:"costUsd"`
+}
+
+func (s *jsonlStore) Append(sessionKey string, msg ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(jsonlRecord{SessionKey: sessionKey, Message: msg})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// readAll loads every record from the JSONL file. The file is append-only,
+// so Delete works by rewriting it with the target session's rows dropped.
+func (s *jsonlStore) readAll() ([]jsonlRecord, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []jsonlRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var rec jsonlRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func (s *jsonlStore) List(sessionKey string, limit int, before, after time.Time) ([]ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	var msgs []ChatMessage
+	for _, rec := range records {
+		if rec.SessionKey == sessionKey {
+			msgs = append(msgs, rec.Message)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Timestamp.Before(msgs[j].Timestamp) })
+	return filterAndLimit(msgs, limit, before, after), nil
+}
+
+func (s *jsonlStore) Delete(sessionKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readAll()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, rec := range records {
+		if rec.SessionKey == sessionKey {
+			continue
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonlStore) Search(sessionKey, query string) ([]ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	var msgs []ChatMessage
+	for _, rec := range records {
+		if rec.SessionKey == sessionKey && messageContains(rec.Message, query) {
+			msgs = append(msgs, rec.Message)
+		}
+	}
+	return msgs, nil
+}
+
+func (s *jsonlStore) RecordUsage(sessionKey, model string, inputTokens, outputTokens int64, costUsd float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.usagePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(jsonlUsageRecord{
+		SessionKey: sessionKey, Model: model,
+		InputTokens: inputTokens, OutputTokens: outputTokens, CostUsd: costUsd,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// readAllUsage loads every recorded usage increment.
+func (s *jsonlStore) readAllUsage() ([]jsonlUsageRecord, error) {
+	f, err := os.Open(s.usagePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []jsonlUsageRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var rec jsonlUsageRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func (s *jsonlStore) UsageBySession(sessionKey string) (UsageTotals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readAllUsage()
+	if err != nil {
+		return UsageTotals{}, err
+	}
+	var t UsageTotals
+	for _, rec := range records {
+		if rec.SessionKey == sessionKey {
+			t.add(rec.InputTokens, rec.OutputTokens, rec.CostUsd)
+		}
+	}
+	return t, nil
+}
+
+func (s *jsonlStore) UsageByModel() (map[string]UsageTotals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readAllUsage()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]UsageTotals{}
+	for _, rec := range records {
+		t := out[rec.Model]
+		t.add(rec.InputTokens, rec.OutputTokens, rec.CostUsd)
+		out[rec.Model] = t
+	}
+	return out, nil
+}
+
+func (s *jsonlStore) UsageTotal() (UsageTotals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readAllUsage()
+	if err != nil {
+		return UsageTotals{}, err
+	}
+	var t UsageTotals
+	for _, rec := range records {
+		t.add(rec.InputTokens, rec.OutputTokens, rec.CostUsd)
+	}
+	return t, nil
+}
+
+func (s *jsonlStore) ResetUsage() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Truncate(s.usagePath, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// messageContains reports whether any text content block of msg contains
+// query, case-insensitively (matches sqliteStore.Search's LOWER(text) LIKE).
+func messageContains(msg ChatMessage, query string) bool {
+	query = strings.ToLower(query)
+	for _, c := range msg.Content {
+		if strings.Contains(strings.ToLower(c.Text), query) {
+			return true
+		}
+	}
+	return false
+}
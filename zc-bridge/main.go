@@ -1,586 +1,936 @@
 package main
 
 import (
-    "bytes"
-    "encoding/json"
-    "fmt"
-    "log"
-    "net/http"
-    "os"
-    "sync"
-    "time"
-
-    "github.com/gorilla/websocket"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 var (
-    addr        = ":18789"
-    zeroclawURL = getenv("ZEROCLAW_URL", "http://zeroclaw:3000/webhook")
-    upgrader    = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	addr           = ":18789"
+	zeroclawURL    = getenv("ZEROCLAW_URL", "http://zeroclaw:3000/webhook")
+	zeroclawStream = getenv("ZEROCLAW_STREAM_URL", "")
+	upgrader       = websocket.Upgrader{CheckOrigin: checkOrigin}
 )
 
 type Frame struct {
-    Type    string          `json:"type"`
-    ID      string          `json:"id,omitempty"`
-    Method  string          `json:"method,omitempty"`
-    Params  json.RawMessage `json:"params,omitempty"`
-    Ok      bool            `json:"ok,omitempty"`
-    Payload json.RawMessage `json:"payload,omitempty"`
-    Error   *ErrPayload     `json:"error,omitempty"`
-    Event   string          `json:"event,omitempty"`
-    Seq     int64           `json:"seq,omitempty"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Ok      bool            `json:"ok,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   *ErrPayload     `json:"error,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Seq     int64           `json:"seq,omitempty"`
 }
 
 type ErrPayload struct {
-    Code    string `json:"code"`
-    Message string `json:"message"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type Session struct {
-    Key       string    `json:"key"`
-    Status    string    `json:"status"`
-    Model     string    `json:"model"`
-    CreatedAt time.Time `json:"createdAt"`
+	Key       string    `json:"key"`
+	Status    string    `json:"status"`
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"createdAt"`
 }
 
 // ContentBlock represents a content block in ClawSuite message format
 type ContentBlock struct {
-    Type string `json:"type"` // "text"
-    Text string `json:"text"`
+	Type string `json:"type"` // "text"
+	Text string `json:"text"`
 }
 
 // ChatMessage represents a single message in history
 type ChatMessage struct {
-    Role    string         `json:"role"`
-    Content []ContentBlock `json:"content"` // Array of content blocks
+	Role      string         `json:"role"`
+	Content   []ContentBlock `json:"content"` // Array of content blocks
+	Timestamp time.Time      `json:"timestamp"`
 }
 
 var (
-    sessions      = map[string]*Session{}
-    sessionsMu    sync.Mutex
-    seq           int64
-    chatHistory   = map[string][]ChatMessage{} // sessionKey -> messages
-    chatHistoryMu sync.Mutex
+	sessions   = map[string]*Session{}
+	sessionsMu sync.Mutex
+	seq        int64
+
+	store HistoryStore
+
+	runs   = map[string]context.CancelFunc{} // runId -> cancel for in-flight forwards
+	runsMu sync.Mutex
 )
 
+// registerRun tracks a cancel func for runId so chat.cancel can abort it.
+func registerRun(runId string, cancel context.CancelFunc) {
+	runsMu.Lock()
+	runs[runId] = cancel
+	runsMu.Unlock()
+}
+
+// unregisterRun drops runId once the forward has completed or been cancelled.
+func unregisterRun(runId string) {
+	runsMu.Lock()
+	delete(runs, runId)
+	runsMu.Unlock()
+}
+
+// cancelRun aborts an in-flight run, returning false if no such run exists.
+func cancelRun(runId string) bool {
+	runsMu.Lock()
+	cancel, ok := runs[runId]
+	runsMu.Unlock()
+	if !ok {
+		return false
+	}
+	cancel()
+	return true
+}
+
 func getenv(k, d string) string {
-    v := os.Getenv(k)
-    if v == "" {
-        return d
-    }
-    return v
+	v := os.Getenv(k)
+	if v == "" {
+		return d
+	}
+	return v
 }
 
 func mustJSON(v any) json.RawMessage {
-    b, _ := json.Marshal(v)
-    return b
+	b, _ := json.Marshal(v)
+	return b
 }
 
 func nextSeq() int64 {
-    seq++
-    return seq
+	return atomic.AddInt64(&seq, 1)
 }
 
-// addMessage appends a message to the chat history for a session
+// addMessage appends a message to the chat history for a session.
 func addMessage(sessionKey, role, text string) {
-    chatHistoryMu.Lock()
-    defer chatHistoryMu.Unlock()
-    chatHistory[sessionKey] = append(chatHistory[sessionKey], ChatMessage{
-        Role:    role,
-        Content: []ContentBlock{{Type: "text", Text: text}},
-    })
-    if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
-        preview := text
-        if len(preview) > 80 {
-            preview = preview[:80]
-        }
-        log.Printf("[history] add sessionKey=%s role=%s len=%d preview=%q", sessionKey, role, len(text), preview)
-    }
-}
-
-// getMessages returns messages for a session (up to limit)
-func getMessages(sessionKey string, limit int) []ChatMessage {
-    chatHistoryMu.Lock()
-    defer chatHistoryMu.Unlock()
-    msgs := chatHistory[sessionKey]
-    if limit > 0 && len(msgs) > limit {
-        return msgs[len(msgs)-limit:]
-    }
-    return msgs
+	msg := ChatMessage{
+		Role:      role,
+		Content:   []ContentBlock{{Type: "text", Text: text}},
+		Timestamp: time.Now(),
+	}
+	if err := store.Append(sessionKey, msg); err != nil {
+		log.Printf("[history] append error sessionKey=%s: %s", sessionKey, err)
+	}
+	if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
+		preview := text
+		if len(preview) > 80 {
+			preview = preview[:80]
+		}
+		log.Printf("[history] add sessionKey=%s role=%s len=%d preview=%q", sessionKey, role, len(text), preview)
+	}
+}
+
+// getMessages returns up to limit messages for a session, optionally
+// paginated with before/after cursors (zero value means unbounded).
+func getMessages(sessionKey string, limit int, before, after time.Time) []ChatMessage {
+	msgs, err := store.List(sessionKey, limit, before, after)
+	if err != nil {
+		log.Printf("[history] list error sessionKey=%s: %s", sessionKey, err)
+		return nil
+	}
+	return msgs
 }
 
 func safeWriteJSON(ws *websocket.Conn, mu *sync.Mutex, v any) error {
-    mu.Lock()
-    defer mu.Unlock()
-    return ws.WriteJSON(v)
+	mu.Lock()
+	defer mu.Unlock()
+	return ws.WriteJSON(v)
 }
 
 func safeWriteControl(ws *websocket.Conn, mu *sync.Mutex, messageType int, data []byte, deadline time.Time) error {
-    mu.Lock()
-    defer mu.Unlock()
-    return ws.WriteControl(messageType, data, deadline)
+	mu.Lock()
+	defer mu.Unlock()
+	return ws.WriteControl(messageType, data, deadline)
 }
 
 func main() {
-    http.HandleFunc("/", handleWS)
-    log.Println("zc-bridge listening on", addr)
-    log.Fatal(http.ListenAndServe(addr, nil))
+	s, err := newHistoryStore(getenv("ZC_BRIDGE_STORE", "memory"))
+	if err != nil {
+		log.Fatalf("history store: %s", err)
+	}
+	store = s
+
+	http.HandleFunc("/", handleWS)
+	log.Println("zc-bridge listening on", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
 }
 
 func handleWS(w http.ResponseWriter, r *http.Request) {
-    ws, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        log.Println(err)
-        return
-    }
-    defer ws.Close()
-
-    writeMu := &sync.Mutex{}
-
-    log.Println("client connected")
-
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:  "event",
-        Event: "connect.challenge",
-        Payload: mustJSON(map[string]any{
-            "nonce": time.Now().UnixNano(),
-        }),
-    })
-
-    for {
-        var f Frame
-        if err := ws.ReadJSON(&f); err != nil {
-            return
-        }
-        if f.Type == "req" && f.Method == "connect" {
-            safeWriteJSON(ws, writeMu, Frame{Type: "res", ID: f.ID, Ok: true})
-            break
-        }
-    }
-
-    log.Println("gateway authenticated")
-
-    go heartbeat(ws, writeMu)
-
-    for {
-        var f Frame
-        if err := ws.ReadJSON(&f); err != nil {
-            return
-        }
-        if f.Type != "req" {
-            continue
-        }
-        go handleRPC(ws, writeMu, f)
-    }
-}
-
-func heartbeat(ws *websocket.Conn, writeMu *sync.Mutex) {
-    t := time.NewTicker(30 * time.Second)
-    for range t.C {
-        safeWriteControl(ws, writeMu, websocket.PingMessage, []byte("ping"), time.Now().Add(2*time.Second))
-    }
-}
-
-func handleRPC(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
-        log.Printf("[rpc] method=%s id=%s paramsLen=%d", f.Method, f.ID, len(f.Params))
-    }
-
-    // Handle all known methods locally or via ZeroClaw
-    switch f.Method {
-    case "sessions.list":
-        handleSessionsList(ws, writeMu, f)
-    case "models.list":
-        handleModelsList(ws, writeMu, f)
-    case "sessions.patch":
-        handleSessionsPatch(ws, writeMu, f)
-    case "sessions.resolve":
-        handleSessionsResolve(ws, writeMu, f)
-    case "sessions.status":
-        handleSessionsStatus(ws, writeMu, f)
-    case "session.status":
-        handleSessionStatus(ws, writeMu, f)
-    case "sessions.usage":
-        handleSessionsUsage(ws, writeMu, f)
-    case "usage.cost":
-        handleUsageCost(ws, writeMu, f)
-    case "usage.status":
-        handleUsageStatus(ws, writeMu, f)
-    case "status":
-        handleStatus(ws, writeMu, f)
-    case "cron.list", "cron.jobs.list", "scheduler.jobs.list":
-        handleEmptyList(ws, writeMu, f)
-    case "chat.history":
-        handleChatHistory(ws, writeMu, f)
-    case "sessions.send", "chat.send":
-        handleZeroClawForward(ws, writeMu, f)
-    default:
-        sendError(ws, writeMu, f.ID, "unsupported method: "+f.Method)
-    }
+	if !checkBearerToken(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="zc-bridge"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer ws.Close()
+
+	writeMu := &sync.Mutex{}
+	limiter := newTokenBucket(rpcRateBurst, rpcRatePerSec)
+
+	// connCtx is cancelled the moment this connection goes away (disconnect
+	// or idle timeout), so every in-flight forward tied to it is aborted
+	// promptly instead of leaking until its own request finishes.
+	connCtx, connCancel := context.WithCancel(context.Background())
+	defer connCancel()
+
+	idle := newDeadlineTimer(pongWait)
+	defer idle.Stop()
+	go func() {
+		// idle.Reset (called on every inbound frame, below) swaps in a
+		// fresh channel and wakes any watcher parked on the old one, so
+		// C() must be re-fetched each pass and checked against IsCurrent
+		// to tell a genuine expiry from a Reset that raced in.
+		for {
+			c := idle.C()
+			select {
+			case <-c:
+				if !idle.IsCurrent(c) {
+					continue
+				}
+				log.Println("connection idle timeout, closing")
+				connCancel()
+				ws.Close()
+				return
+			case <-connCtx.Done():
+				return
+			}
+		}
+	}()
+
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		idle.Reset(pongWait)
+		return nil
+	})
+
+	log.Println("client connected")
+
+	nonce := fmt.Sprintf("%d", time.Now().UnixNano())
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:  "event",
+		Event: "connect.challenge",
+		Payload: mustJSON(map[string]any{
+			"nonce": nonce,
+		}),
+	})
+
+	for {
+		var f Frame
+		if err := ws.ReadJSON(&f); err != nil {
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		idle.Reset(pongWait)
+		if f.Type != "req" || f.Method != "connect" {
+			continue
+		}
+		if err := verifyConnect(nonce, f.Params); err != nil {
+			sendCodedError(ws, writeMu, f.ID, "auth_failed", err.Error())
+			closeConn(ws, writeMu, websocket.ClosePolicyViolation, "auth_failed")
+			return
+		}
+		safeWriteJSON(ws, writeMu, Frame{Type: "res", ID: f.ID, Ok: true})
+		break
+	}
+
+	log.Println("gateway authenticated")
+
+	go heartbeat(ws, writeMu, connCtx)
+
+	for {
+		var f Frame
+		if err := ws.ReadJSON(&f); err != nil {
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		idle.Reset(pongWait)
+		if f.Type != "req" {
+			continue
+		}
+		go handleRPC(ws, writeMu, limiter, connCtx, f)
+	}
+}
+
+func heartbeat(ws *websocket.Conn, writeMu *sync.Mutex, connCtx context.Context) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			safeWriteControl(ws, writeMu, websocket.PingMessage, []byte("ping"), time.Now().Add(2*time.Second))
+		case <-connCtx.Done():
+			return
+		}
+	}
+}
+
+func handleRPC(ws *websocket.Conn, writeMu *sync.Mutex, limiter *tokenBucket, connCtx context.Context, f Frame) {
+	if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
+		log.Printf("[rpc] method=%s id=%s paramsLen=%d", f.Method, f.ID, len(f.Params))
+	}
+
+	if !limiter.Allow() {
+		sendCodedError(ws, writeMu, f.ID, "rate_limited", "too many requests")
+		return
+	}
+
+	// Handle all known methods locally or via ZeroClaw
+	switch f.Method {
+	case "sessions.list":
+		handleSessionsList(ws, writeMu, f)
+	case "models.list":
+		handleModelsList(ws, writeMu, f)
+	case "providers.list":
+		handleProvidersList(ws, writeMu, f)
+	case "sessions.patch":
+		handleSessionsPatch(ws, writeMu, f)
+	case "sessions.resolve":
+		handleSessionsResolve(ws, writeMu, f)
+	case "sessions.status":
+		handleSessionsStatus(ws, writeMu, f)
+	case "session.status":
+		handleSessionStatus(ws, writeMu, f)
+	case "sessions.usage":
+		handleSessionsUsage(ws, writeMu, f)
+	case "usage.cost":
+		handleUsageCost(ws, writeMu, f)
+	case "usage.status":
+		handleUsageStatus(ws, writeMu, f)
+	case "usage.reset":
+		handleUsageReset(ws, writeMu, f)
+	case "status":
+		handleStatus(ws, writeMu, f)
+	case "cron.list", "cron.jobs.list", "scheduler.jobs.list":
+		handleEmptyList(ws, writeMu, f)
+	case "chat.history":
+		handleChatHistory(ws, writeMu, f)
+	case "chat.history.delete":
+		handleChatHistoryDelete(ws, writeMu, f)
+	case "chat.history.search":
+		handleChatHistorySearch(ws, writeMu, f)
+	case "sessions.send", "chat.send":
+		handleChatSend(ws, writeMu, connCtx, f)
+	case "chat.cancel":
+		handleChatCancel(ws, writeMu, f)
+	default:
+		sendError(ws, writeMu, f.ID, "unsupported method: "+f.Method)
+	}
 }
 
 // --- Local RPC handlers ---
 
 func handleSessionsList(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    sessionsMu.Lock()
-    list := make([]*Session, 0, len(sessions))
-    for _, s := range sessions {
-        list = append(list, s)
-    }
-    sessionsMu.Unlock()
-
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{"sessions": list}),
-    })
+	sessionsMu.Lock()
+	list := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	sessionsMu.Unlock()
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"sessions": list}),
+	})
 }
 
 func handleModelsList(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "models": []string{"kimi-k2.5"},
-        }),
-    })
+	var models []string
+	for _, p := range providerRegistry.all() {
+		models = append(models, p.Models()...)
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"models": models,
+		}),
+	})
+}
+
+func handleProvidersList(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
+	type providerInfo struct {
+		Name   string   `json:"name"`
+		Models []string `json:"models"`
+	}
+	var list []providerInfo
+	for _, p := range providerRegistry.all() {
+		list = append(list, providerInfo{Name: p.Name(), Models: p.Models()})
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"providers": list}),
+	})
 }
 
 func handleSessionsPatch(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{}),
-    })
+	var params struct {
+		Key      string `json:"key"`
+		Provider string `json:"provider"`
+		Model    string `json:"model"`
+	}
+	if len(f.Params) > 0 {
+		if err := json.Unmarshal(f.Params, &params); err != nil {
+			sendError(ws, writeMu, f.ID, "invalid params: "+err.Error())
+			return
+		}
+	}
+	if params.Key == "" {
+		params.Key = "main"
+	}
+
+	sessionsMu.Lock()
+	s, ok := sessions[params.Key]
+	if !ok {
+		s = &Session{Key: params.Key, Status: "idle", CreatedAt: time.Now()}
+		sessions[params.Key] = s
+	}
+	if params.Provider != "" {
+		s.Provider = params.Provider
+	}
+	if params.Model != "" {
+		s.Model = params.Model
+	}
+	sessionsMu.Unlock()
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"key": s.Key, "provider": s.Provider, "model": s.Model}),
+	})
 }
 
 func handleSessionsResolve(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    // Parse params to get key
-    var params struct {
-        Key string `json:"key"`
-    }
-    key := "main"
-    if len(f.Params) > 0 {
-        if err := json.Unmarshal(f.Params, &params); err == nil && params.Key != "" {
-            key = params.Key
-        }
-    }
-
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{"ok": true, "key": key}),
-    })
+	// Parse params to get key
+	var params struct {
+		Key string `json:"key"`
+	}
+	key := "main"
+	if len(f.Params) > 0 {
+		if err := json.Unmarshal(f.Params, &params); err == nil && params.Key != "" {
+			key = params.Key
+		}
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"ok": true, "key": key}),
+	})
 }
 
 func handleSessionsStatus(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "sessions": []any{},
-        }),
-    })
+	sessionsMu.Lock()
+	list := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	sessionsMu.Unlock()
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"sessions": list,
+		}),
+	})
 }
 
 func handleSessionStatus(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "status": "idle",
-        }),
-    })
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"status": "idle",
+		}),
+	})
 }
 
 func handleSessionsUsage(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "sessions": []any{},
-            "totalInputTokens":  0,
-            "totalOutputTokens": 0,
-            "totalCostUsd":      0.0,
-        }),
-    })
+	sessionsMu.Lock()
+	keys := make([]string, 0, len(sessions))
+	for k := range sessions {
+		keys = append(keys, k)
+	}
+	sessionsMu.Unlock()
+
+	type sessionUsage struct {
+		SessionKey string `json:"sessionKey"`
+		UsageTotals
+	}
+	perSession := make([]sessionUsage, 0, len(keys))
+	for _, k := range keys {
+		t, err := store.UsageBySession(k)
+		if err != nil {
+			sendError(ws, writeMu, f.ID, err.Error())
+			return
+		}
+		perSession = append(perSession, sessionUsage{SessionKey: k, UsageTotals: t})
+	}
+
+	total, err := store.UsageTotal()
+	if err != nil {
+		sendError(ws, writeMu, f.ID, err.Error())
+		return
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"sessions":          perSession,
+			"totalInputTokens":  total.InputTokens,
+			"totalOutputTokens": total.OutputTokens,
+			"totalCostUsd":      total.CostUsd,
+		}),
+	})
 }
 
 func handleUsageCost(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "totalCostUsd":      0.0,
-            "totalInputTokens":  0,
-            "totalOutputTokens": 0,
-            "byModel":           map[string]any{},
-        }),
-    })
+	total, err := store.UsageTotal()
+	if err != nil {
+		sendError(ws, writeMu, f.ID, err.Error())
+		return
+	}
+	byModel, err := store.UsageByModel()
+	if err != nil {
+		sendError(ws, writeMu, f.ID, err.Error())
+		return
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"totalCostUsd":      total.CostUsd,
+			"totalInputTokens":  total.InputTokens,
+			"totalOutputTokens": total.OutputTokens,
+			"byModel":           byModel,
+		}),
+	})
+}
+
+func handleUsageReset(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
+	if err := store.ResetUsage(); err != nil {
+		sendError(ws, writeMu, f.ID, err.Error())
+		return
+	}
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"reset": true}),
+	})
 }
 
 func handleUsageStatus(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "available": true,
-        }),
-    })
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"available": true,
+		}),
+	})
 }
 
 func handleStatus(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "status":  "ok",
-            "version": "zc-bridge-1.0",
-        }),
-    })
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"status":  "ok",
+			"version": "zc-bridge-1.0",
+		}),
+	})
 }
 
 func handleEmptyList(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "jobs": []any{},
-        }),
-    })
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"jobs": []any{},
+		}),
+	})
 }
 
 func handleChatHistory(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    // Parse params
-    var params struct {
-        SessionKey string `json:"sessionKey"`
-        Limit      int    `json:"limit"`
-    }
-    sessionKey := "main"
-    limit := 200
-    if len(f.Params) > 0 {
-        if err := json.Unmarshal(f.Params, &params); err == nil {
-            if params.SessionKey != "" {
-                sessionKey = params.SessionKey
-            }
-            if params.Limit > 0 {
-                limit = params.Limit
-            }
-        }
-    }
-
-    msgs := getMessages(sessionKey, limit)
-
-    if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
-        log.Printf("[history] get sessionKey=%s limit=%d returning=%d", sessionKey, limit, len(msgs))
-        for i, m := range msgs {
-            // Log first content block text
-            var preview string
-            if len(m.Content) > 0 && m.Content[0].Type == "text" {
-                preview = m.Content[0].Text
-                if len(preview) > 60 {
-                    preview = preview[:60]
-                }
-            }
-            log.Printf("[history] msg[%d] role=%s content=[{type:text text:%q}]", i, m.Role, preview)
-        }
-    }
-
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{
-            "sessionKey": sessionKey,
-            "messages":   msgs,
-        }),
-    })
-}
-
-func handleZeroClawForward(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
-    if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
-        log.Printf("[forward] method=%s id=%s", f.Method, f.ID)
-    }
-
-    // Parse params
-    var params struct {
-        SessionKey     string `json:"sessionKey"`
-        Message        string `json:"message"`
-        IdempotencyKey string `json:"idempotencyKey"`
-    }
-    if len(f.Params) > 0 {
-        if err := json.Unmarshal(f.Params, &params); err != nil {
-            sendError(ws, writeMu, f.ID, "invalid params: "+err.Error())
-            return
-        }
-    }
-    if params.Message == "" {
-        sendError(ws, writeMu, f.ID, "missing params.message")
-        return
-    }
-
-    // Determine sessionKey (fallback to "main")
-    sessionKey := params.SessionKey
-    if sessionKey == "" {
-        sessionKey = "main"
-    }
-
-    // Determine runId
-    runId := params.IdempotencyKey
-    if runId == "" {
-        runId = fmt.Sprintf("run_%d", time.Now().UnixNano())
-    }
-
-    // Store user message in history
-    addMessage(sessionKey, "user", params.Message)
-
-    // Build ZeroClaw webhook payload
-    body := map[string]any{
-        "message": params.Message,
-    }
-
-    j, _ := json.Marshal(body)
-
-    req, err := http.NewRequest("POST", zeroclawURL, bytes.NewReader(j))
-    if err != nil {
-        log.Printf("[forward] error: %s", err)
-        sendError(ws, writeMu, f.ID, err.Error())
-        return
-    }
-    req.Header.Set("Content-Type", "application/json")
-
-    token := os.Getenv("ZEROCLAW_BEARER_TOKEN")
-    if token != "" {
-        req.Header.Set("Authorization", "Bearer "+token)
-    }
-
-    resp, err := http.DefaultClient.Do(req)
-    if err != nil {
-        log.Printf("[forward] error: %s", err)
-        sendError(ws, writeMu, f.ID, err.Error())
-        return
-    }
-    defer resp.Body.Close()
-
-    if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
-        log.Printf("[forward] zeroclaw status=%d", resp.StatusCode)
-    }
-
-    // Read full response body
-    b := make([]byte, 0)
-    if resp.Body != nil {
-        buf := make([]byte, 4096)
-        for {
-            n, readErr := resp.Body.Read(buf)
-            if n > 0 {
-                b = append(b, buf[:n]...)
-            }
-            if readErr != nil {
-                break
-            }
-        }
-    }
-
-    // Check for error status
-    if resp.StatusCode >= 400 {
-        sendError(ws, writeMu, f.ID, fmt.Sprintf("zeroclaw %d: %s", resp.StatusCode, string(b)))
-        return
-    }
-
-    // Extract assistant text from response
-    assistantText := ""
-    var m map[string]any
-    if json.Unmarshal(b, &m) == nil {
-        // Try common keys
-        for _, key := range []string{"response", "message", "text", "output"} {
-            if v, ok := m[key]; ok {
-                if s, ok := v.(string); ok && s != "" {
-                    assistantText = s
-                    break
-                }
-            }
-        }
-        // Try nested data.text
-        if assistantText == "" {
-            if data, ok := m["data"].(map[string]any); ok {
-                if v, ok := data["text"]; ok {
-                    if s, ok := v.(string); ok && s != "" {
-                        assistantText = s
-                    }
-                }
-            }
-        }
-    }
-    // Fallback to raw string if not found
-    if assistantText == "" {
-        assistantText = string(b)
-    }
-    if assistantText == "" {
-        assistantText = "(empty response)"
-    }
-
-    // Store assistant message in history
-    addMessage(sessionKey, "assistant", assistantText)
-
-    // Send RPC response frame first
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:    "res",
-        ID:      f.ID,
-        Ok:      true,
-        Payload: mustJSON(map[string]any{"runId": runId}),
-    })
-
-    // Emit agent event
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:  "event",
-        Event: "agent",
-        Seq:   nextSeq(),
-        Payload: mustJSON(map[string]any{
-            "runId":      runId,
-            "sessionKey": sessionKey,
-            "stream":     "assistant",
-            "data": map[string]any{
-                "text": assistantText,
-            },
-        }),
-    })
-
-    // Emit chat final event
-    safeWriteJSON(ws, writeMu, Frame{
-        Type:  "event",
-        Event: "chat",
-        Seq:   nextSeq(),
-        Payload: mustJSON(map[string]any{
-            "runId":      runId,
-            "sessionKey": sessionKey,
-            "state":      "final",
-            "message": map[string]any{
-                "role": "assistant",
-                "content": []ContentBlock{{Type: "text", Text: assistantText}},
-            },
-        }),
-    })
+	// Parse params
+	var params struct {
+		SessionKey string `json:"sessionKey"`
+		Limit      int    `json:"limit"`
+		Before     int64  `json:"before"` // unix millis cursor, exclusive
+		After      int64  `json:"after"`  // unix millis cursor, exclusive
+	}
+	sessionKey := "main"
+	limit := 200
+	if len(f.Params) > 0 {
+		if err := json.Unmarshal(f.Params, &params); err == nil {
+			if params.SessionKey != "" {
+				sessionKey = params.SessionKey
+			}
+			if params.Limit > 0 {
+				limit = params.Limit
+			}
+		}
+	}
+
+	var before, after time.Time
+	if params.Before > 0 {
+		before = time.UnixMilli(params.Before)
+	}
+	if params.After > 0 {
+		after = time.UnixMilli(params.After)
+	}
+
+	msgs := getMessages(sessionKey, limit, before, after)
+
+	if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
+		log.Printf("[history] get sessionKey=%s limit=%d returning=%d", sessionKey, limit, len(msgs))
+		for i, m := range msgs {
+			// Log first content block text
+			var preview string
+			if len(m.Content) > 0 && m.Content[0].Type == "text" {
+				preview = m.Content[0].Text
+				if len(preview) > 60 {
+					preview = preview[:60]
+				}
+			}
+			log.Printf("[history] msg[%d] role=%s content=[{type:text text:%q}]", i, m.Role, preview)
+		}
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"sessionKey": sessionKey,
+			"messages":   msgs,
+		}),
+	})
+}
+
+func handleChatHistoryDelete(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
+	var params struct {
+		SessionKey string `json:"sessionKey"`
+	}
+	if len(f.Params) > 0 {
+		if err := json.Unmarshal(f.Params, &params); err != nil {
+			sendError(ws, writeMu, f.ID, "invalid params: "+err.Error())
+			return
+		}
+	}
+	if params.SessionKey == "" {
+		sendError(ws, writeMu, f.ID, "missing params.sessionKey")
+		return
+	}
+
+	if err := store.Delete(params.SessionKey); err != nil {
+		sendError(ws, writeMu, f.ID, err.Error())
+		return
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"sessionKey": params.SessionKey, "deleted": true}),
+	})
+}
+
+func handleChatHistorySearch(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
+	var params struct {
+		SessionKey string `json:"sessionKey"`
+		Query      string `json:"query"`
+	}
+	sessionKey := "main"
+	if len(f.Params) > 0 {
+		if err := json.Unmarshal(f.Params, &params); err != nil {
+			sendError(ws, writeMu, f.ID, "invalid params: "+err.Error())
+			return
+		}
+	}
+	if params.SessionKey != "" {
+		sessionKey = params.SessionKey
+	}
+	if params.Query == "" {
+		sendError(ws, writeMu, f.ID, "missing params.query")
+		return
+	}
+
+	msgs, err := store.Search(sessionKey, params.Query)
+	if err != nil {
+		sendError(ws, writeMu, f.ID, err.Error())
+		return
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   f.ID,
+		Ok:   true,
+		Payload: mustJSON(map[string]any{
+			"sessionKey": sessionKey,
+			"messages":   msgs,
+		}),
+	})
+}
+
+// emitAgentEvent sends an incremental or final "agent" event for runId.
+func emitAgentEvent(ws *websocket.Conn, writeMu *sync.Mutex, runId, sessionKey, state, delta, text string) {
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:  "event",
+		Event: "agent",
+		Seq:   nextSeq(),
+		Payload: mustJSON(map[string]any{
+			"runId":      runId,
+			"sessionKey": sessionKey,
+			"stream":     "assistant",
+			"state":      state,
+			"data": map[string]any{
+				"delta": delta,
+				"text":  text,
+			},
+		}),
+	})
+}
+
+// emitChatFinal sends the terminal "chat" event carrying the full assistant message.
+func emitChatFinal(ws *websocket.Conn, writeMu *sync.Mutex, runId, sessionKey, state, text string) {
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:  "event",
+		Event: "chat",
+		Seq:   nextSeq(),
+		Payload: mustJSON(map[string]any{
+			"runId":      runId,
+			"sessionKey": sessionKey,
+			"state":      state,
+			"message": map[string]any{
+				"role":    "assistant",
+				"content": []ContentBlock{{Type: "text", Text: text}},
+			},
+		}),
+	})
+}
+
+func handleChatSend(ws *websocket.Conn, writeMu *sync.Mutex, connCtx context.Context, f Frame) {
+	if os.Getenv("ZC_BRIDGE_DEBUG") == "1" {
+		log.Printf("[forward] method=%s id=%s", f.Method, f.ID)
+	}
+
+	// Parse params
+	var params struct {
+		SessionKey     string `json:"sessionKey"`
+		Message        string `json:"message"`
+		IdempotencyKey string `json:"idempotencyKey"`
+	}
+	if len(f.Params) > 0 {
+		if err := json.Unmarshal(f.Params, &params); err != nil {
+			sendError(ws, writeMu, f.ID, "invalid params: "+err.Error())
+			return
+		}
+	}
+	if params.Message == "" {
+		sendError(ws, writeMu, f.ID, "missing params.message")
+		return
+	}
+
+	// Determine sessionKey (fallback to "main")
+	sessionKey := params.SessionKey
+	if sessionKey == "" {
+		sessionKey = "main"
+	}
+
+	// Determine runId
+	runId := params.IdempotencyKey
+	if runId == "" {
+		runId = fmt.Sprintf("run_%d", time.Now().UnixNano())
+	}
+
+	// Store user message in history, then look up the provider for this
+	// session (falls back to the registry default if sessions.patch was
+	// never called).
+	addMessage(sessionKey, "user", params.Message)
+	provider := resolveProvider(sessionKey)
+	if provider == nil {
+		sendError(ws, writeMu, f.ID, "no provider configured")
+		return
+	}
+
+	model := resolveModel(provider, sessionKey)
+
+	ctx, cancel := context.WithTimeout(connCtx, upstreamTimeout())
+	registerRun(runId, cancel)
+	defer func() {
+		cancel()
+		unregisterRun(runId)
+	}()
+
+	deltas, err := provider.Send(ctx, sessionKey, model, getMessages(sessionKey, 0, time.Time{}, time.Time{}))
+	if err != nil {
+		if state := abortState(ctx); state != "" {
+			emitAgentEvent(ws, writeMu, runId, sessionKey, state, "", "")
+			return
+		}
+		sendError(ws, writeMu, f.ID, err.Error())
+		return
+	}
+
+	// The connection to the upstream is established: let the client start
+	// rendering before the first delta arrives.
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"runId": runId}),
+	})
+
+	var aggregated strings.Builder
+	var usage *TokenUsage
+	for d := range deltas {
+		if d.Err != nil {
+			emitAgentEvent(ws, writeMu, runId, sessionKey, "final", "", d.Err.Error())
+			return
+		}
+		if d.Text != "" {
+			aggregated.WriteString(d.Text)
+			emitAgentEvent(ws, writeMu, runId, sessionKey, "delta", d.Text, aggregated.String())
+		}
+		if d.Usage != nil {
+			usage = d.Usage
+		}
+	}
+
+	if state := abortState(ctx); state != "" {
+		emitAgentEvent(ws, writeMu, runId, sessionKey, state, "", aggregated.String())
+		return
+	}
+
+	assistantText := aggregated.String()
+	if assistantText == "" {
+		assistantText = "(empty response)"
+	}
+
+	// Store assistant message in history
+	addMessage(sessionKey, "assistant", assistantText)
+
+	if usage == nil {
+		usage = &TokenUsage{InputTokens: approxTokens(params.Message), OutputTokens: approxTokens(assistantText)}
+	}
+	recordAndEmitUsage(ws, writeMu, sessionKey, model, *usage)
+
+	emitAgentEvent(ws, writeMu, runId, sessionKey, "final", "", assistantText)
+	emitChatFinal(ws, writeMu, runId, sessionKey, "final", assistantText)
+}
+
+// resolveModel returns the model that will actually be billed and sent on
+// the wire for sessionKey: the one assigned via sessions.patch, or
+// provider's own first model if the session never set one, or "unknown" if
+// neither is available. Call sites must pass this same value into
+// Provider.Send so the model that's billed is the model that's called.
+func resolveModel(provider Provider, sessionKey string) string {
+	sessionsMu.Lock()
+	s, ok := sessions[sessionKey]
+	sessionsMu.Unlock()
+	if ok && s.Model != "" {
+		return s.Model
+	}
+	if models := provider.Models(); len(models) > 0 {
+		return models[0]
+	}
+	return "unknown"
+}
+
+// resolveProvider returns the provider assigned to sessionKey via
+// sessions.patch, or the registry default if none was set.
+func resolveProvider(sessionKey string) Provider {
+	sessionsMu.Lock()
+	s, ok := sessions[sessionKey]
+	sessionsMu.Unlock()
+
+	if ok && s.Provider != "" {
+		if p, ok := providerRegistry.byProviderName(s.Provider); ok {
+			return p
+		}
+	}
+	if ok && s.Model != "" {
+		if p, ok := providerRegistry.byModelName(s.Model); ok {
+			return p
+		}
+	}
+	return providerRegistry.defaultProvider()
+}
+
+func handleChatCancel(ws *websocket.Conn, writeMu *sync.Mutex, f Frame) {
+	var params struct {
+		RunId string `json:"runId"`
+	}
+	if len(f.Params) > 0 {
+		if err := json.Unmarshal(f.Params, &params); err != nil {
+			sendError(ws, writeMu, f.ID, "invalid params: "+err.Error())
+			return
+		}
+	}
+	if params.RunId == "" {
+		sendError(ws, writeMu, f.ID, "missing params.runId")
+		return
+	}
+
+	ok := cancelRun(params.RunId)
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:    "res",
+		ID:      f.ID,
+		Ok:      true,
+		Payload: mustJSON(map[string]any{"runId": params.RunId, "cancelled": ok}),
+	})
 }
 
 func sendError(ws *websocket.Conn, writeMu *sync.Mutex, id, msg string) {
-    safeWriteJSON(ws, writeMu, Frame{
-        Type: "res",
-        ID:   id,
-        Ok:   false,
-        Error: &ErrPayload{
-            Code:    "bridge_error",
-            Message: msg,
-        },
-    })
-}
\ No newline at end of file
+	sendCodedError(ws, writeMu, id, "bridge_error", msg)
+}
+
+func sendCodedError(ws *websocket.Conn, writeMu *sync.Mutex, id, code, msg string) {
+	safeWriteJSON(ws, writeMu, Frame{
+		Type: "res",
+		ID:   id,
+		Ok:   false,
+		Error: &ErrPayload{
+			Code:    code,
+			Message: msg,
+		},
+	})
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Delta is one increment of an in-flight provider response. Providers close
+// their channel after sending a Delta with Done set (or Err on failure).
+type Delta struct {
+	Text  string
+	Done  bool
+	Err   error
+	Usage *TokenUsage // set on the final delta when the provider reports real counts
+}
+
+// Provider routes chat messages to a specific backend (webhook, OpenAI-
+// compatible API, Ollama, ...) and streams the reply back as deltas.
+type Provider interface {
+	Name() string
+	Models() []string
+	// Send dispatches messages to model (the session's selected model, or
+	// "" to let the provider pick its own default) and streams the reply.
+	Send(ctx context.Context, sessionKey, model string, messages []ChatMessage) (<-chan Delta, error)
+}
+
+// --- config file ---
+
+// ProviderConfig declares one entry of ZC_BRIDGE_CONFIG.
+type ProviderConfig struct {
+	Name       string   `json:"name" yaml:"name"`
+	Kind       string   `json:"kind" yaml:"kind"` // "zeroclaw" | "openai" | "ollama"
+	BaseURL    string   `json:"baseUrl" yaml:"baseUrl"`
+	AuthHeader string   `json:"authHeader" yaml:"authHeader"`
+	AuthToken  string   `json:"authToken" yaml:"authToken"`
+	Models     []string `json:"models" yaml:"models"`
+}
+
+// BridgeConfig is the top-level shape of ZC_BRIDGE_CONFIG.
+type BridgeConfig struct {
+	Providers []ProviderConfig `json:"providers" yaml:"providers"`
+}
+
+// loadBridgeConfig reads path as YAML or JSON based on its extension.
+func loadBridgeConfig(path string) (*BridgeConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var cfg BridgeConfig
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		if err := yaml.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("parse yaml config: %w", err)
+		}
+	} else {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("parse json config: %w", err)
+		}
+	}
+	return &cfg, nil
+}
+
+// --- registry ---
+
+// registry holds every configured Provider, keyed by name, plus an index
+// from model name to the provider that serves it.
+type registry struct {
+	byName  map[string]Provider
+	byModel map[string]Provider
+	names   []string // insertion order, for stable models.list/providers.list output
+}
+
+func newRegistry() *registry {
+	return &registry{byName: map[string]Provider{}, byModel: map[string]Provider{}}
+}
+
+func (r *registry) add(p Provider) {
+	r.byName[p.Name()] = p
+	r.names = append(r.names, p.Name())
+	for _, m := range p.Models() {
+		r.byModel[m] = p
+	}
+}
+
+func (r *registry) all() []Provider {
+	out := make([]Provider, 0, len(r.names))
+	for _, n := range r.names {
+		out = append(out, r.byName[n])
+	}
+	return out
+}
+
+func (r *registry) byProviderName(name string) (Provider, bool) {
+	p, ok := r.byName[name]
+	return p, ok
+}
+
+func (r *registry) byModelName(model string) (Provider, bool) {
+	p, ok := r.byModel[model]
+	return p, ok
+}
+
+// defaultProvider is served to sessions that never called sessions.patch.
+func (r *registry) defaultProvider() Provider {
+	if p, ok := r.byName["zeroclaw"]; ok {
+		return p
+	}
+	for _, n := range r.names {
+		return r.byName[n]
+	}
+	return nil
+}
+
+// providerRegistry is populated from ZC_BRIDGE_CONFIG, falling back to the
+// single ZeroClaw webhook provider (ZEROCLAW_URL/ZEROCLAW_STREAM_URL) when
+// no config file is set, matching the bridge's original behavior.
+var providerRegistry = buildProviderRegistry()
+
+func buildProviderRegistry() *registry {
+	reg := newRegistry()
+
+	configPath := getenv("ZC_BRIDGE_CONFIG", "")
+	if configPath == "" {
+		reg.add(newZeroClawProvider("zeroclaw", zeroclawURL, zeroclawStream, os.Getenv("ZEROCLAW_BEARER_TOKEN"), []string{"kimi-k2.5"}))
+		return reg
+	}
+
+	cfg, err := loadBridgeConfig(configPath)
+	if err != nil {
+		log.Printf("[providers] %s; falling back to default zeroclaw provider", err)
+		reg.add(newZeroClawProvider("zeroclaw", zeroclawURL, zeroclawStream, os.Getenv("ZEROCLAW_BEARER_TOKEN"), []string{"kimi-k2.5"}))
+		return reg
+	}
+
+	for _, pc := range cfg.Providers {
+		switch pc.Kind {
+		case "zeroclaw":
+			reg.add(newZeroClawProvider(pc.Name, pc.BaseURL, "", pc.AuthToken, pc.Models))
+		case "openai":
+			reg.add(newOpenAIProvider(pc.Name, pc.BaseURL, pc.AuthHeader, pc.AuthToken, pc.Models))
+		case "ollama":
+			reg.add(newOllamaProvider(pc.Name, pc.BaseURL, pc.Models))
+		default:
+			log.Printf("[providers] skipping %q: unknown kind %q", pc.Name, pc.Kind)
+		}
+	}
+	return reg
+}
+
+// --- shared SSE/chunked helpers ---
+
+// isStreaming reports whether resp looks like an SSE or chunked delta stream.
+func isStreaming(resp *http.Response) bool {
+	ct := resp.Header.Get("Content-Type")
+	if strings.Contains(ct, "text/event-stream") {
+		return true
+	}
+	for _, enc := range resp.TransferEncoding {
+		if enc == "chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+// --- ZeroClaw webhook provider ---
+
+type zeroclawProvider struct {
+	name        string
+	url         string
+	streamURL   string
+	bearerToken string
+	models      []string
+}
+
+func newZeroClawProvider(name, url, streamURL, bearerToken string, models []string) *zeroclawProvider {
+	return &zeroclawProvider{name: name, url: url, streamURL: streamURL, bearerToken: bearerToken, models: models}
+}
+
+func (p *zeroclawProvider) Name() string     { return p.name }
+func (p *zeroclawProvider) Models() []string { return p.models }
+
+func (p *zeroclawProvider) Send(ctx context.Context, sessionKey, model string, messages []ChatMessage) (<-chan Delta, error) {
+	url := p.url
+	if p.streamURL != "" {
+		url = p.streamURL
+	}
+
+	lastMessage := ""
+	if len(messages) > 0 {
+		last := messages[len(messages)-1]
+		if len(last.Content) > 0 {
+			lastMessage = last.Content[0].Text
+		}
+	}
+
+	body := map[string]any{"message": lastMessage}
+	if model != "" {
+		body["model"] = model
+	}
+	j, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	if p.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.bearerToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delta, 8)
+	go func() {
+		defer close(out)
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 400 {
+			b, _ := io.ReadAll(resp.Body)
+			out <- Delta{Err: fmt.Errorf("zeroclaw %d: %s", resp.StatusCode, string(b))}
+			return
+		}
+
+		if isStreaming(resp) {
+			streamSSE(ctx, resp.Body, out, func(payload string) (string, bool, *TokenUsage) {
+				var chunk struct {
+					Delta string `json:"delta"`
+					Text  string `json:"text"`
+					Done  bool   `json:"done"`
+				}
+				if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+					return payload, false, nil
+				}
+				d := chunk.Delta
+				if d == "" {
+					d = chunk.Text
+				}
+				return d, chunk.Done, nil
+			})
+			return
+		}
+
+		b, _ := io.ReadAll(resp.Body)
+		out <- Delta{Text: extractAssistantText(b), Done: true}
+	}()
+	return out, nil
+}
+
+// extractAssistantText pulls the assistant reply out of a one-shot
+// ZeroClaw webhook JSON body, trying the common response shapes.
+func extractAssistantText(b []byte) string {
+	var m map[string]any
+	if json.Unmarshal(b, &m) == nil {
+		for _, key := range []string{"response", "message", "text", "output"} {
+			if v, ok := m[key]; ok {
+				if s, ok := v.(string); ok && s != "" {
+					return s
+				}
+			}
+		}
+		if data, ok := m["data"].(map[string]any); ok {
+			if v, ok := data["text"]; ok {
+				if s, ok := v.(string); ok && s != "" {
+					return s
+				}
+			}
+		}
+	}
+	return string(b)
+}
+
+// --- OpenAI-compatible provider ---
+
+type openAIProvider struct {
+	name       string
+	baseURL    string
+	authHeader string
+	authToken  string
+	models     []string
+}
+
+func newOpenAIProvider(name, baseURL, authHeader, authToken string, models []string) *openAIProvider {
+	if authHeader == "" {
+		authHeader = "Authorization"
+	}
+	return &openAIProvider{name: name, baseURL: baseURL, authHeader: authHeader, authToken: authToken, models: models}
+}
+
+func (p *openAIProvider) Name() string     { return p.name }
+func (p *openAIProvider) Models() []string { return p.models }
+
+func (p *openAIProvider) Send(ctx context.Context, sessionKey, model string, messages []ChatMessage) (<-chan Delta, error) {
+	if model == "" && len(p.models) > 0 {
+		model = p.models[0]
+	}
+
+	body := map[string]any{
+		"model":          model,
+		"messages":       toOpenAIMessages(messages),
+		"stream":         true,
+		"stream_options": map[string]any{"include_usage": true},
+	}
+	j, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(p.baseURL, "/")+"/v1/chat/completions", bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.authToken != "" {
+		req.Header.Set(p.authHeader, p.authToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delta, 8)
+	go func() {
+		defer close(out)
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 400 {
+			b, _ := io.ReadAll(resp.Body)
+			out <- Delta{Err: fmt.Errorf("openai %d: %s", resp.StatusCode, string(b))}
+			return
+		}
+
+		streamSSE(ctx, resp.Body, out, func(payload string) (string, bool, *TokenUsage) {
+			if payload == "[DONE]" {
+				return "", true, nil
+			}
+			var chunk struct {
+				Choices []struct {
+					Delta struct {
+						Content string `json:"content"`
+					} `json:"delta"`
+					FinishReason string `json:"finish_reason"`
+				} `json:"choices"`
+				Usage *struct {
+					PromptTokens     int64 `json:"prompt_tokens"`
+					CompletionTokens int64 `json:"completion_tokens"`
+				} `json:"usage"`
+			}
+			if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+				return "", false, nil
+			}
+			var usage *TokenUsage
+			if chunk.Usage != nil {
+				usage = &TokenUsage{InputTokens: chunk.Usage.PromptTokens, OutputTokens: chunk.Usage.CompletionTokens}
+			}
+			if len(chunk.Choices) == 0 {
+				return "", false, usage
+			}
+			return chunk.Choices[0].Delta.Content, chunk.Choices[0].FinishReason != "", usage
+		})
+	}()
+	return out, nil
+}
+
+func toOpenAIMessages(messages []ChatMessage) []map[string]string {
+	out := make([]map[string]string, 0, len(messages))
+	for _, m := range messages {
+		text := ""
+		if len(m.Content) > 0 {
+			text = m.Content[0].Text
+		}
+		out = append(out, map[string]string{"role": m.Role, "content": text})
+	}
+	return out
+}
+
+// --- Ollama provider ---
+
+type ollamaProvider struct {
+	name    string
+	baseURL string
+	models  []string
+}
+
+func newOllamaProvider(name, baseURL string, models []string) *ollamaProvider {
+	return &ollamaProvider{name: name, baseURL: baseURL, models: models}
+}
+
+func (p *ollamaProvider) Name() string     { return p.name }
+func (p *ollamaProvider) Models() []string { return p.models }
+
+func (p *ollamaProvider) Send(ctx context.Context, sessionKey, model string, messages []ChatMessage) (<-chan Delta, error) {
+	if model == "" && len(p.models) > 0 {
+		model = p.models[0]
+	}
+
+	body := map[string]any{
+		"model":    model,
+		"messages": toOpenAIMessages(messages),
+		"stream":   true,
+	}
+	j, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(p.baseURL, "/")+"/api/chat", bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delta, 8)
+	go func() {
+		defer close(out)
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 400 {
+			b, _ := io.ReadAll(resp.Body)
+			out <- Delta{Err: fmt.Errorf("ollama %d: %s", resp.StatusCode, string(b))}
+			return
+		}
+
+		// Ollama streams newline-delimited JSON objects, not SSE.
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if ctx.Err() != nil {
+				return
+			}
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var chunk struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+				Done            bool  `json:"done"`
+				PromptEvalCount int64 `json:"prompt_eval_count"`
+				EvalCount       int64 `json:"eval_count"`
+			}
+			if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+				continue
+			}
+			var usage *TokenUsage
+			if chunk.Done && (chunk.PromptEvalCount > 0 || chunk.EvalCount > 0) {
+				usage = &TokenUsage{InputTokens: chunk.PromptEvalCount, OutputTokens: chunk.EvalCount}
+			}
+			if chunk.Message.Content != "" || chunk.Done {
+				out <- Delta{Text: chunk.Message.Content, Done: chunk.Done, Usage: usage}
+			}
+			if chunk.Done {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// streamSSE scans resp.Body for "data: ..." lines, calling parse on each
+// payload to get (delta, done); it stops at ctx cancellation or the first
+// done=true chunk, emitting one Delta per non-empty fragment.
+func streamSSE(ctx context.Context, body io.Reader, out chan<- Delta, parse func(payload string) (delta string, done bool, usage *TokenUsage)) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		delta, done, usage := parse(payload)
+		if delta != "" || done || usage != nil {
+			out <- Delta{Text: delta, Done: done, Usage: usage}
+		}
+		if done {
+			return
+		}
+	}
+	out <- Delta{Done: true}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// TokenUsage is an input/output token count pulled either from a provider's
+// own response or from the heuristic fallback tokenizer.
+type TokenUsage struct {
+	InputTokens  int64
+	OutputTokens int64
+}
+
+// ModelPrice is the per-1K-token price for one model, loaded from
+// ZC_BRIDGE_PRICING.
+type ModelPrice struct {
+	InputPer1K  float64 `json:"inputPer1K"`
+	OutputPer1K float64 `json:"outputPer1K"`
+}
+
+var (
+	priceTableMu sync.RWMutex
+	priceTable   = loadPriceTable(getenv("ZC_BRIDGE_PRICING", ""))
+)
+
+// loadPriceTable reads a JSON file mapping model name -> ModelPrice. An
+// unset or unreadable path yields an empty table, meaning $0 cost for every
+// model (matches the bridge's original hardcoded zeros).
+func loadPriceTable(path string) map[string]ModelPrice {
+	table := map[string]ModelPrice{}
+	if path == "" {
+		return table
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("[usage] could not read pricing table %s: %s", path, err)
+		return table
+	}
+	if err := json.Unmarshal(b, &table); err != nil {
+		log.Printf("[usage] could not parse pricing table %s: %s", path, err)
+		return map[string]ModelPrice{}
+	}
+	return table
+}
+
+func priceFor(model string) ModelPrice {
+	priceTableMu.RLock()
+	defer priceTableMu.RUnlock()
+	return priceTable[model]
+}
+
+// computeCost multiplies token counts by the configured per-model price.
+func computeCost(model string, usage TokenUsage) float64 {
+	price := priceFor(model)
+	return float64(usage.InputTokens)/1000*price.InputPer1K + float64(usage.OutputTokens)/1000*price.OutputPer1K
+}
+
+// approxTokens is a fallback token estimate for providers that don't report
+// real usage: a flat 4-characters-per-token ratio, not a tokenizer of any
+// kind, but close enough for cost estimation without pulling one in.
+func approxTokens(s string) int64 {
+	if s == "" {
+		return 0
+	}
+	n := int64(len(s)) / 4
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// recordAndEmitUsage persists a usage increment and pushes a live "usage"
+// event so connected UIs can update their totals without polling.
+func recordAndEmitUsage(ws *websocket.Conn, writeMu *sync.Mutex, sessionKey, model string, usage TokenUsage) {
+	cost := computeCost(model, usage)
+	if err := store.RecordUsage(sessionKey, model, usage.InputTokens, usage.OutputTokens, cost); err != nil {
+		log.Printf("[usage] record error sessionKey=%s model=%s: %s", sessionKey, model, err)
+		return
+	}
+
+	total, err := store.UsageBySession(sessionKey)
+	if err != nil {
+		log.Printf("[usage] totals error sessionKey=%s: %s", sessionKey, err)
+		return
+	}
+
+	safeWriteJSON(ws, writeMu, Frame{
+		Type:  "event",
+		Event: "usage",
+		Seq:   nextSeq(),
+		Payload: mustJSON(map[string]any{
+			"sessionKey":        sessionKey,
+			"model":             model,
+			"inputTokens":       usage.InputTokens,
+			"outputTokens":      usage.OutputTokens,
+			"costUsd":           cost,
+			"totalInputTokens":  total.InputTokens,
+			"totalOutputTokens": total.OutputTokens,
+			"totalCostUsd":      total.CostUsd,
+		}),
+	})
+}
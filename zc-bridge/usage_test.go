@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApproxTokens(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want int64
+	}{
+		{"empty", "", 0},
+		{"short rounds up to one token", "hi", 1},
+		{"exact multiple of four", "12345678", 2},
+		{"partial remainder truncates", "123456789", 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := approxTokens(c.in); got != c.want {
+				t.Errorf("approxTokens(%q) = %d, want %d", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prices.json")
+	body := `{"gpt-4o": {"inputPer1K": 0.005, "outputPer1K": 0.015}}`
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	table := loadPriceTable(path)
+	got, ok := table["gpt-4o"]
+	if !ok {
+		t.Fatalf("expected gpt-4o entry in loaded price table, got %v", table)
+	}
+	if got.InputPer1K != 0.005 || got.OutputPer1K != 0.015 {
+		t.Errorf("loadPriceTable entry = %+v, want {0.005 0.015}", got)
+	}
+}
+
+func TestLoadPriceTableMissingOrInvalidPath(t *testing.T) {
+	if table := loadPriceTable(""); len(table) != 0 {
+		t.Errorf("expected empty table for unset path, got %v", table)
+	}
+	if table := loadPriceTable(filepath.Join(t.TempDir(), "does-not-exist.json")); len(table) != 0 {
+		t.Errorf("expected empty table for unreadable path, got %v", table)
+	}
+}
+
+func TestComputeCost(t *testing.T) {
+	priceTableMu.Lock()
+	prev := priceTable
+	priceTable = map[string]ModelPrice{
+		"gpt-4o": {InputPer1K: 0.005, OutputPer1K: 0.015},
+	}
+	priceTableMu.Unlock()
+	t.Cleanup(func() {
+		priceTableMu.Lock()
+		priceTable = prev
+		priceTableMu.Unlock()
+	})
+
+	cost := computeCost("gpt-4o", TokenUsage{InputTokens: 2000, OutputTokens: 1000})
+	want := 2*0.005 + 1*0.015
+	if cost != want {
+		t.Errorf("computeCost = %v, want %v", cost, want)
+	}
+}
+
+func TestComputeCostUnknownModelIsZero(t *testing.T) {
+	cost := computeCost("some-model-with-no-price-entry", TokenUsage{InputTokens: 1000, OutputTokens: 1000})
+	if cost != 0 {
+		t.Errorf("computeCost for unpriced model = %v, want 0", cost)
+	}
+}
+
+func TestUsageTotalsAdd(t *testing.T) {
+	var totals UsageTotals
+	totals.add(100, 50, 0.01)
+	totals.add(200, 75, 0.02)
+	if totals.InputTokens != 300 || totals.OutputTokens != 125 || totals.CostUsd != 0.03 {
+		t.Errorf("totals = %+v, want {300 125 0.03}", totals)
+	}
+}